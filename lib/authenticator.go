@@ -0,0 +1,111 @@
+/*
+Copyright (c) 2014 Ashley Jeffs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, sub to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jeffail/util/log"
+)
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+/*
+Authenticator - The contract every leaps authentication backend must satisfy: decide whether a
+token authorises creating a document as a given user, decide whether a token authorises joining an
+existing document, and register whatever HTTP endpoints it needs (issuing tokens, OAuth2 redirects,
+etc) against the admin API.
+*/
+type Authenticator interface {
+	AuthoriseCreate(token, userID string) bool
+	AuthoriseJoin(token, documentID string) bool
+	RegisterHandlers(register PubPrivEndpointRegister) error
+}
+
+/*
+AuthenticatorCtor - Builds an Authenticator from its raw (per-type) JSON config. Implementations
+are expected to json.Unmarshal config into whichever concrete config type they expect.
+*/
+type AuthenticatorCtor func(config json.RawMessage, logger *log.Logger, stats *log.Stats) (Authenticator, error)
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+var (
+	authenticatorRegistryMutex sync.Mutex
+	authenticatorRegistry      = map[string]AuthenticatorCtor{}
+)
+
+/*
+RegisterAuthenticator - Registers an Authenticator constructor under a name, so that it can be
+selected at runtime via the `{"type": "<name>", "config": {...}}` authenticator config shape.
+Implementations call this from their own init() function (the pattern Harbor uses for its
+token.InitCreators registry, and client-go uses for its auth provider plugins), so that adding a new
+authenticator never requires touching a central switch statement.
+*/
+func RegisterAuthenticator(name string, ctor AuthenticatorCtor) {
+	authenticatorRegistryMutex.Lock()
+	defer authenticatorRegistryMutex.Unlock()
+
+	if _, exists := authenticatorRegistry[name]; exists {
+		panic(fmt.Sprintf("authenticator already registered under name: %v", name))
+	}
+	authenticatorRegistry[name] = ctor
+}
+
+/*
+AuthenticatorConfig - The outer, type-tagged config object used to select and configure an
+Authenticator at runtime.
+*/
+type AuthenticatorConfig struct {
+	Type   string          `json:"type" yaml:"type"`
+	Config json.RawMessage `json:"config" yaml:"config"`
+}
+
+/*
+NewAuthenticator - Looks up the Authenticator registered under config.Type and constructs it with
+config.Config. Returns an error naming every registered type if config.Type is not recognised.
+*/
+func NewAuthenticator(config AuthenticatorConfig, logger *log.Logger, stats *log.Stats) (Authenticator, error) {
+	authenticatorRegistryMutex.Lock()
+	ctor, exists := authenticatorRegistry[config.Type]
+	names := make([]string, 0, len(authenticatorRegistry))
+	for name := range authenticatorRegistry {
+		names = append(names, name)
+	}
+	authenticatorRegistryMutex.Unlock()
+
+	if !exists {
+		sort.Strings(names)
+		return nil, fmt.Errorf("unrecognised authenticator type '%v', registered types are: %v", config.Type, names)
+	}
+
+	return ctor(config.Config, logger, stats)
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */
@@ -24,24 +24,58 @@ package lib
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"path"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/jeffail/util/log"
 )
 
+/*--------------------------------------------------------------------------------------------------
+ */
+
+func init() {
+	RegisterAuthenticator("http", func(config json.RawMessage, logger *log.Logger, stats *log.Stats) (Authenticator, error) {
+		var cfg TokenAuthenticatorConfig
+		if err := json.Unmarshal(config, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse http authenticator config: %v", err)
+		}
+		return NewHTTPAuthenticator(cfg, logger, stats)
+	})
+}
+
 /*--------------------------------------------------------------------------------------------------
  */
 
 /*
-HTTPAuthenticatorConfig - A config object for the HTTP API authentication object.
+HTTPAuthenticatorConfig - A config object for the HTTP API authentication object. ReplayCacheSize
+bounds the in-process replay cache's LRU list (see replayCache); if traffic issuing tokens with a
+max_uses greater than 1 is heavy enough to evict a token's entry before all of its uses are consumed,
+the jar's own record that the jti has been touched at all will cause its remaining uses to be
+rejected early (see CheckAndUse). Size this generously relative to the number of multi-use tokens
+expected to be outstanding at once if that matters to your deployment; the default single-use
+behaviour is unaffected either way.
 */
 type HTTPAuthenticatorConfig struct {
-	Path         string `json:"path" yaml:"path"`
-	ExpiryPeriod int64  `json:"expiry_period_s" yaml:"expiry_period_s"`
+	Path             string `json:"path" yaml:"path"`
+	ExpiryPeriod     int64  `json:"expiry_period_s" yaml:"expiry_period_s"`
+	Issuer           string `json:"issuer" yaml:"issuer"`
+	Audience         string `json:"audience" yaml:"audience"`
+	SigningAlgorithm string `json:"signing_algorithm" yaml:"signing_algorithm"`
+	SigningKeyPath   string `json:"signing_key_path" yaml:"signing_key_path"`
+	PublicKeyPath    string `json:"public_key_path" yaml:"public_key_path"`
+	ReplayCacheSize  int    `json:"replay_cache_size" yaml:"replay_cache_size"`
+
+	TokenJar FileTokenJarConfig `json:"token_jar" yaml:"token_jar"`
+
+	RateLimitRPS   float64 `json:"rate_limit_rps" yaml:"rate_limit_rps"`
+	RateLimitBurst int     `json:"rate_limit_burst" yaml:"rate_limit_burst"`
 }
 
 /*
@@ -49,188 +83,442 @@ NewHTTPAuthenticatorConfig - Returns a default config object for a HTTPAuthentic
 */
 func NewHTTPAuthenticatorConfig() HTTPAuthenticatorConfig {
 	return HTTPAuthenticatorConfig{
-		Path:         "",
-		ExpiryPeriod: 60,
+		Path:             "",
+		ExpiryPeriod:     60,
+		Issuer:           "leaps",
+		Audience:         "leaps-clients",
+		SigningAlgorithm: "HS256",
+		SigningKeyPath:   "",
+		PublicKeyPath:    "",
+		ReplayCacheSize:  10000,
+		TokenJar:         NewFileTokenJarConfig(),
+		RateLimitRPS:     5,
+		RateLimitBurst:   10,
 	}
 }
 
 /*--------------------------------------------------------------------------------------------------
  */
 
-func (h *HTTPAuthenticator) serveGenerateToken(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "POST endpoint only", http.StatusMethodNotAllowed)
-		return
+/*
+scopeCreate / scopeJoinPrefix - The values placed in the `scope` claim of a leaps auth token. A
+create token simply carries `scopeCreate`, a join token carries `scopeJoinPrefix` followed by the
+target document ID.
+*/
+const (
+	scopeCreate     = "create"
+	scopeJoinPrefix = "join:"
+)
+
+/*
+leapsClaims - The JWT claims carried by a leaps auth token, on top of the standard registered
+claims (iss, aud, exp, iat, sub, jti). MaxUses defaults to 1 (today's single-use behaviour) when
+omitted or non-positive; a token requesting more than one use is only tracked for its extra uses
+in-process (via the replay cache's in-memory use counter), so that count does not survive a restart
+even though the file-backed jar still remembers that the token was touched at all.
+*/
+type leapsClaims struct {
+	jwt.StandardClaims
+	Scope   string `json:"scope"`
+	MaxUses int    `json:"mu,omitempty"`
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+/*
+serveGenerateToken - Returns a handler that reads `{"key_value": "<...>"}` from the request body and
+issues a signed token. scopeFor derives the `scope` claim from the submitted key (e.g. always
+`create`, or `join:<key>`); the key itself is always used as the token subject.
+*/
+func (h *HTTPAuthenticator) serveGenerateToken(scopeFor func(key string) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST endpoint only", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !h.limiter.Allow(remoteIP(r)) {
+			h.stats.Incr("http_authenticator.tokens.rejected", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(h.limiter.RetryAfter()))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		bytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			h.logger.Errorf("Failed to read request body: %v\n", err)
+			http.Error(w, "Bad request: could not read body", http.StatusBadRequest)
+			return
+		}
+
+		var bodyObj struct {
+			Key     string `json:"key_value"`
+			MaxUses int    `json:"max_uses"`
+		}
+		if err = json.Unmarshal(bytes, &bodyObj); err != nil {
+			h.logger.Errorf("Failed to parse request body: %v\n", err)
+			http.Error(w, "Bad request: could not parse body", http.StatusBadRequest)
+			return
+		}
+
+		if 0 == len(bodyObj.Key) {
+			h.logger.Errorln("User ID not found in request body")
+			http.Error(w, "Bad request: no user id found", http.StatusBadRequest)
+			return
+		}
+
+		token, err := h.generateToken(scopeFor(bodyObj.Key), bodyObj.Key, bodyObj.MaxUses)
+		if err != nil {
+			h.logger.Errorf("Failed to sign token: %v\n", err)
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		h.stats.Incr("http_authenticator.tokens.issued", 1)
+
+		resBytes, err := json.Marshal(struct {
+			Token string `json:"token"`
+		}{
+			Token: token,
+		})
+		if err != nil {
+			h.logger.Errorf("Failed to generate JSON response: %v\n", err)
+			http.Error(w, "Failed to generate response", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(resBytes)
 	}
+}
 
-	bytes, err := ioutil.ReadAll(r.Body)
+/*
+remoteIP - Extracts the caller's IP from the request, stripping the port added by net/http. Falls
+back to the raw RemoteAddr if it isn't in host:port form (e.g. behind some test harnesses).
+*/
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		h.logger.Errorf("Failed to read request body: %v\n", err)
-		http.Error(w, "Bad request: could not read body", http.StatusBadRequest)
-		return
+		return r.RemoteAddr
 	}
+	return host
+}
 
-	var bodyObj struct {
-		Key string `json:"key_value"`
-	}
-	if err = json.Unmarshal(bytes, &bodyObj); err != nil {
-		h.logger.Errorf("Failed to parse request body: %v\n", err)
-		http.Error(w, "Bad request: could not parse body", http.StatusBadRequest)
-		return
+/*
+generateToken - Builds and signs a JWT carrying the given scope (`create` or `join:<document_id>`)
+and subject (the user or document ID the scope grants access to). A maxUses of 0 or less defaults to
+1, matching the single-use behaviour of the original token map.
+*/
+func (h *HTTPAuthenticator) generateToken(scope, subject string, maxUses int) (string, error) {
+	if maxUses <= 0 {
+		maxUses = 1
 	}
 
-	if 0 == len(bodyObj.Key) {
-		h.logger.Errorln("User ID not found in request body")
-		http.Error(w, "Bad request: no user id found", http.StatusBadRequest)
-		return
+	now := time.Now()
+	jti := GenerateStampedUUID()
+
+	claims := leapsClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    h.config.HTTPConfig.Issuer,
+			Audience:  h.config.HTTPConfig.Audience,
+			Subject:   subject,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(time.Second * time.Duration(h.config.HTTPConfig.ExpiryPeriod)).Unix(),
+			Id:        jti,
+		},
+		Scope:   scope,
+		MaxUses: maxUses,
 	}
 
-	token := GenerateStampedUUID()
+	token := jwt.NewWithClaims(h.signingMethod, claims)
+	return token.SignedString(h.signingKey)
+}
 
-	h.mutex.Lock()
+/*
+verifyTokenClaims - Parses a token string and validates its signature, expiry and issuer/audience,
+returning the claims within if they all check out. This does not touch the replay cache, so it is
+safe to call on a token that the caller is only inspecting rather than redeeming.
+*/
+func (h *HTTPAuthenticator) verifyTokenClaims(tokenStr string) (*leapsClaims, error) {
+	claims := &leapsClaims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != h.signingMethod.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return h.verifyKey, nil
+	})
+	if err != nil {
+		h.stats.Incr("http_authenticator.tokens.rejected", 1)
+		return nil, err
+	}
 
-	h.tokens[token] = tokenMapValue{
-		value:   bodyObj.Key,
-		expires: time.Now().Add(time.Second * time.Duration(h.config.HTTPConfig.ExpiryPeriod)),
+	if err = claims.StandardClaims.Valid(); err != nil {
+		h.stats.Incr("http_authenticator.tokens.expired", 1)
+		return nil, err
+	}
+	if claims.Issuer != h.config.HTTPConfig.Issuer || claims.Audience != h.config.HTTPConfig.Audience {
+		h.stats.Incr("http_authenticator.tokens.rejected", 1)
+		return nil, fmt.Errorf("token issuer/audience mismatch")
+	}
+	if 0 == len(claims.Id) {
+		h.stats.Incr("http_authenticator.tokens.rejected", 1)
+		return nil, fmt.Errorf("token missing jti claim")
 	}
-	h.mutex.Unlock()
+	return claims, nil
+}
 
-	resBytes, err := json.Marshal(struct {
-		Token string `json:"token"`
-	}{
-		Token: token,
-	})
+/*
+verifyToken - As verifyTokenClaims, but additionally checks the jti against the replay cache and
+records a use, so that a token can only ever be redeemed maxUses times, matching the single-use
+semantics of the original in-memory token map. Only call this for a request that is actually
+exercising the token's grant (AuthoriseCreate/AuthoriseJoin); a caller that merely wants to know
+whether a token is still valid, without spending one of its uses, should call verifyTokenClaims
+instead.
+*/
+func (h *HTTPAuthenticator) verifyToken(tokenStr string) (*leapsClaims, error) {
+	claims, err := h.verifyTokenClaims(tokenStr)
 	if err != nil {
-		h.logger.Errorf("Failed to generate JSON response: %v\n", err)
-		http.Error(w, "Failed to generate response", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	w.Write(resBytes)
-	w.Header().Add("Content-Type", "application/json")
+	if !h.replay.CheckAndUse(claims.Id, time.Unix(claims.ExpiresAt, 0), claims.MaxUses) {
+		h.stats.Incr("http_authenticator.tokens.rejected", 1)
+		return nil, fmt.Errorf("token has already been redeemed")
+	}
 
-	h.clearExpiredTokens()
+	h.stats.Incr("http_authenticator.tokens.consumed", 1)
+	return claims, nil
 }
 
 /*--------------------------------------------------------------------------------------------------
  */
 
-type tokenMapValue struct {
-	value   string
-	expires time.Time
-}
-
-type tokensMap map[string]tokenMapValue
-
 /*
 HTTPAuthenticator - Uses the admin HTTP server to expose an endpoint for submitting authentication
-tokens.
+tokens. Tokens are signed JWTs, verified statelessly against a configured key, so the authenticator
+itself holds no per-token state beyond a replay cache used to enforce each token's use limit (a
+bounded in-process LRU list plus a token jar that records every redeemed jti until it expires).
 */
 type HTTPAuthenticator struct {
 	logger *log.Logger
 	stats  *log.Stats
 	config TokenAuthenticatorConfig
 	mutex  sync.RWMutex
-	tokens tokensMap
+
+	signingMethod jwt.SigningMethod
+	signingKey    interface{}
+	verifyKey     interface{}
+	replay        *replayCache
+	limiter       *ipRateLimiter
 }
 
 /*
 NewHTTPAuthenticator - Creates an HTTPAuthenticator using the provided configuration.
 */
-func NewHTTPAuthenticator(config TokenAuthenticatorConfig, logger *log.Logger, stats *log.Stats) *HTTPAuthenticator {
-	return &HTTPAuthenticator{
-		logger: logger.NewModule(":http_auth"),
-		stats:  stats,
-		config: config,
-		mutex:  sync.RWMutex{},
-		tokens: tokensMap{},
+func NewHTTPAuthenticator(config TokenAuthenticatorConfig, logger *log.Logger, stats *log.Stats) (*HTTPAuthenticator, error) {
+	hLogger := logger.NewModule(":http_auth")
+
+	jar, err := NewFileTokenJar(config.HTTPConfig.TokenJar, hLogger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise token jar: %v", err)
+	}
+
+	h := HTTPAuthenticator{
+		logger:  hLogger,
+		stats:   stats,
+		config:  config,
+		mutex:   sync.RWMutex{},
+		replay:  newReplayCache(config.HTTPConfig.ReplayCacheSize, jar),
+		limiter: newIPRateLimiter(config.HTTPConfig.RateLimitRPS, config.HTTPConfig.RateLimitBurst),
 	}
+
+	if err := h.loadSigningKeys(); err != nil {
+		return nil, err
+	}
+
+	go h.sweepLoop()
+
+	return &h, nil
 }
 
-/*--------------------------------------------------------------------------------------------------
- */
+/*
+sweepLoop - Runs Sweep against the replay cache and the per-IP rate limiter every ExpiryPeriod/2
+seconds, so that an idle server still reclaims memory (and jar disk space) without waiting for a
+token request.
+*/
+func (h *HTTPAuthenticator) sweepLoop() {
+	period := h.config.HTTPConfig.ExpiryPeriod / 2
+	if period <= 0 {
+		period = 1
+	}
+
+	for range time.Tick(time.Second * time.Duration(period)) {
+		now := time.Now()
+		h.replay.Sweep(now)
+		h.limiter.Sweep(now)
+	}
+}
 
 /*
-clearExpiredTokens - Purges our expired tokens from the map.
+loadSigningKeys - Resolves the configured signing algorithm and loads the appropriate key material.
+HS256 uses a single shared secret read from SigningKeyPath for both signing and verification. RS256
+signs with a private key read from SigningKeyPath; if PublicKeyPath is set it is read separately and
+used to verify (so that a verify-only instance can hold just the public half), otherwise the verify
+key is derived directly from the parsed private key.
 */
-func (h *HTTPAuthenticator) clearExpiredTokens() {
-	expiredTokens := []string{}
+func (h *HTTPAuthenticator) loadSigningKeys() error {
+	switch h.config.HTTPConfig.SigningAlgorithm {
+	case "", "HS256":
+		h.signingMethod = jwt.SigningMethodHS256
+		secret, err := ioutil.ReadFile(h.config.HTTPConfig.SigningKeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to read HS256 signing key: %v", err)
+		}
+		h.signingKey = secret
+		h.verifyKey = secret
+	case "RS256":
+		h.signingMethod = jwt.SigningMethodRS256
+		privBytes, err := ioutil.ReadFile(h.config.HTTPConfig.SigningKeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to read RS256 private key: %v", err)
+		}
+		privKey, err := jwt.ParseRSAPrivateKeyFromPEM(privBytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse RS256 private key: %v", err)
+		}
+		h.signingKey = privKey
 
-	h.mutex.RLock()
-	for token, val := range h.tokens {
-		if val.expires.Before(time.Now()) {
-			expiredTokens = append(expiredTokens, token)
+		if 0 == len(h.config.HTTPConfig.PublicKeyPath) {
+			h.verifyKey = &privKey.PublicKey
+			return nil
 		}
-	}
-	h.mutex.RUnlock()
 
-	if len(expiredTokens) > 0 {
-		h.mutex.Lock()
-		for _, token := range expiredTokens {
-			delete(h.tokens, token)
+		pubBytes, err := ioutil.ReadFile(h.config.HTTPConfig.PublicKeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to read RS256 public key: %v", err)
+		}
+		pubKey, err := jwt.ParseRSAPublicKeyFromPEM(pubBytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse RS256 public key: %v", err)
 		}
-		h.mutex.Unlock()
+		h.verifyKey = pubKey
+	default:
+		return fmt.Errorf("unsupported signing algorithm: %v", h.config.HTTPConfig.SigningAlgorithm)
 	}
+	return nil
 }
 
 /*--------------------------------------------------------------------------------------------------
  */
 
 /*
-AuthoriseCreate - Checks whether a specific token has been generated for a user through the HTTP
-authentication endpoint for creating a new document.
+AuthoriseCreate - Checks whether a token grants the bearer permission to create a new document as
+userID. The token must verify, be unexpired, not have used up its max uses, and carry a `create`
+scope bound to userID.
 */
 func (h *HTTPAuthenticator) AuthoriseCreate(token, userID string) bool {
 	if !h.config.AllowCreate {
 		return false
 	}
 
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
-
-	if tObj, ok := h.tokens[token]; ok {
-		if tObj.value == userID {
-			delete(h.tokens, token)
-			return true
-		}
+	claims, err := h.verifyToken(token)
+	if err != nil {
+		h.logger.Debugf("Rejected create token: %v\n", err)
+		return false
 	}
-	return false
+
+	return claims.Scope == scopeCreate && claims.Subject == userID
 }
 
 /*
-AuthoriseJoin - Checks whether a specific token has been generated for a document through the HTTP
-authentication endpoint for joining that aforementioned document.
+AuthoriseJoin - Checks whether a token grants the bearer permission to join documentID. The token
+must verify, be unexpired, not have used up its max uses, and carry a `join:<documentID>` scope
+bound to documentID.
 */
 func (h *HTTPAuthenticator) AuthoriseJoin(token, documentID string) bool {
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
-
-	if tObj, ok := h.tokens[token]; ok {
-		if tObj.value == documentID {
-			delete(h.tokens, token)
-			return true
-		}
+	claims, err := h.verifyToken(token)
+	if err != nil {
+		h.logger.Debugf("Rejected join token: %v\n", err)
+		return false
 	}
-	return false
+
+	return claims.Scope == scopeJoinPrefix+documentID && claims.Subject == documentID
 }
 
 /*
-RegisterHandlers - Register endpoints for adding new auth tokens.
+RegisterHandlers - Register endpoints for adding new auth tokens, plus a verification endpoint that
+lets external services validate a leaps token without access to the signing secret.
 */
 func (h *HTTPAuthenticator) RegisterHandlers(register PubPrivEndpointRegister) error {
 	if err := register.RegisterPrivate(
 		path.Join(h.config.HTTPConfig.Path, "create"),
 		`Generate an authentication token for creating a new document, POST: {"key_value":"<user_id>"}`,
-		h.serveGenerateToken,
+		h.serveGenerateToken(func(key string) string { return scopeCreate }),
 	); err != nil {
 		return err
 	}
-	return register.RegisterPrivate(
+	if err := register.RegisterPrivate(
 		path.Join(h.config.HTTPConfig.Path, "join"),
 		`Generate an authentication token for joining an existing document, POST: {"key_value":"<document_id>"}`,
-		h.serveGenerateToken,
+		h.serveGenerateToken(func(key string) string { return scopeJoinPrefix + key }),
+	); err != nil {
+		return err
+	}
+	return register.RegisterPrivate(
+		path.Join("service/token", h.config.HTTPConfig.Path, "verify"),
+		`Verify a leaps auth token on behalf of an external service, POST: {"key_value":"<token>"}`,
+		h.serveVerifyToken,
 	)
 }
 
+/*
+serveVerifyToken - Allows a trusted external service to verify a leaps-issued token and learn its
+scope/subject, without needing the signing secret itself (for RS256 deployments the public key can
+be distributed instead). This checks the token's signature, expiry and issuer/audience only; it does
+not consume a use, so a service calling this to sanity-check a token before a client's real
+create/join request does not burn that token's single use out from under the client.
+*/
+func (h *HTTPAuthenticator) serveVerifyToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST endpoint only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad request: could not read body", http.StatusBadRequest)
+		return
+	}
+
+	var bodyObj struct {
+		Key string `json:"key_value"`
+	}
+	if err = json.Unmarshal(bytes, &bodyObj); err != nil {
+		http.Error(w, "Bad request: could not parse body", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := h.verifyTokenClaims(bodyObj.Key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid token: %v", err), http.StatusUnauthorized)
+		return
+	}
+
+	resBytes, err := json.Marshal(struct {
+		Subject string `json:"subject"`
+		Scope   string `json:"scope"`
+	}{
+		Subject: claims.Subject,
+		Scope:   claims.Scope,
+	})
+	if err != nil {
+		http.Error(w, "Failed to generate response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(resBytes)
+}
+
 /*--------------------------------------------------------------------------------------------------
- */
\ No newline at end of file
+ */
@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jeffail/util/log"
+)
+
+func newTestHTTPAuthenticator(t *testing.T) *HTTPAuthenticator {
+	secret := []byte("test-signing-secret")
+	return &HTTPAuthenticator{
+		config: TokenAuthenticatorConfig{
+			HTTPConfig: HTTPAuthenticatorConfig{
+				Issuer:   "leaps",
+				Audience: "leaps-clients",
+			},
+		},
+		stats:         &log.Stats{},
+		signingMethod: jwt.SigningMethodHS256,
+		signingKey:    secret,
+		verifyKey:     secret,
+		replay:        newReplayCache(10, NewMemoryTokenJar()),
+	}
+}
+
+func TestGenerateAndVerifyTokenRoundTrip(t *testing.T) {
+	h := newTestHTTPAuthenticator(t)
+
+	token, err := h.generateToken(scopeCreate, "alice", 1)
+	if err != nil {
+		t.Fatalf("unexpected error generating token: %v", err)
+	}
+
+	claims, err := h.verifyToken(token)
+	if err != nil {
+		t.Fatalf("unexpected error verifying a freshly generated token: %v", err)
+	}
+	if claims.Subject != "alice" || claims.Scope != scopeCreate {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+}
+
+func TestVerifyTokenRejectsSecondUseOfSingleUseToken(t *testing.T) {
+	h := newTestHTTPAuthenticator(t)
+
+	token, err := h.generateToken(scopeCreate, "alice", 1)
+	if err != nil {
+		t.Fatalf("unexpected error generating token: %v", err)
+	}
+
+	if _, err = h.verifyToken(token); err != nil {
+		t.Fatalf("unexpected error on first verifyToken: %v", err)
+	}
+	if _, err = h.verifyToken(token); err == nil {
+		t.Errorf("expected a second verifyToken call to reject the token as already redeemed")
+	}
+}
+
+func TestVerifyTokenClaimsDoesNotConsumeAUse(t *testing.T) {
+	h := newTestHTTPAuthenticator(t)
+
+	token, err := h.generateToken(scopeCreate, "alice", 1)
+	if err != nil {
+		t.Fatalf("unexpected error generating token: %v", err)
+	}
+
+	if _, err = h.verifyTokenClaims(token); err != nil {
+		t.Fatalf("unexpected error inspecting token claims: %v", err)
+	}
+	if _, err = h.verifyTokenClaims(token); err != nil {
+		t.Fatalf("expected repeated verifyTokenClaims calls to keep succeeding without consuming a use: %v", err)
+	}
+
+	// The token's single use should still be available to the real create/join path.
+	if _, err = h.verifyToken(token); err != nil {
+		t.Errorf("expected the token to still be redeemable after only being inspected via verifyTokenClaims: %v", err)
+	}
+}
+
+func TestVerifyTokenClaimsRejectsExpiredToken(t *testing.T) {
+	h := newTestHTTPAuthenticator(t)
+
+	claims := leapsClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    h.config.HTTPConfig.Issuer,
+			Audience:  h.config.HTTPConfig.Audience,
+			Subject:   "alice",
+			IssuedAt:  time.Now().Add(-time.Hour * 2).Unix(),
+			ExpiresAt: time.Now().Add(-time.Hour).Unix(),
+			Id:        GenerateStampedUUID(),
+		},
+		Scope:   scopeCreate,
+		MaxUses: 1,
+	}
+	token, err := jwt.NewWithClaims(h.signingMethod, claims).SignedString(h.signingKey)
+	if err != nil {
+		t.Fatalf("unexpected error signing test token: %v", err)
+	}
+
+	if _, err = h.verifyTokenClaims(token); err == nil {
+		t.Errorf("expected an expired token to be rejected")
+	}
+}
+
+/*
+writeRSAPrivateKeyPEM - Generates a throwaway RSA key and writes its PKCS1 private key PEM to a file
+under dir, returning the path.
+*/
+func writeRSAPrivateKeyPEM(t *testing.T, dir string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error generating RSA key: %v", err)
+	}
+
+	block := &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}
+
+	path := filepath.Join(dir, "rs256.pem")
+	if err = ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("unexpected error writing RSA key: %v", err)
+	}
+	return path
+}
+
+func TestLoadSigningKeysRS256DerivesVerifyKeyFromPrivateKeyWithoutPublicKeyPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leaps-rs256-test")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := writeRSAPrivateKeyPEM(t, dir)
+
+	h := &HTTPAuthenticator{
+		config: TokenAuthenticatorConfig{
+			HTTPConfig: HTTPAuthenticatorConfig{
+				Issuer:           "leaps",
+				Audience:         "leaps-clients",
+				SigningAlgorithm: "RS256",
+				SigningKeyPath:   keyPath,
+			},
+		},
+		stats:  &log.Stats{},
+		replay: newReplayCache(10, NewMemoryTokenJar()),
+	}
+
+	if err = h.loadSigningKeys(); err != nil {
+		t.Fatalf("expected RS256 keys to load with no public_key_path configured, got: %v", err)
+	}
+
+	token, err := h.generateToken(scopeCreate, "alice", 1)
+	if err != nil {
+		t.Fatalf("unexpected error generating RS256 token: %v", err)
+	}
+	if _, err = h.verifyToken(token); err != nil {
+		t.Errorf("expected a token signed with the private key to verify against the derived public key: %v", err)
+	}
+}
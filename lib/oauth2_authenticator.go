@@ -0,0 +1,587 @@
+/*
+Copyright (c) 2014 Ashley Jeffs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, sub to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/jeffail/util/log"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/bitbucket"
+	"golang.org/x/oauth2/github"
+	"golang.org/x/oauth2/google"
+)
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+func init() {
+	RegisterAuthenticator("oauth2", func(config json.RawMessage, logger *log.Logger, stats *log.Stats) (Authenticator, error) {
+		var cfg TokenAuthenticatorConfig
+		if err := json.Unmarshal(config, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse oauth2 authenticator config: %v", err)
+		}
+		return NewOAuth2Authenticator(cfg, logger, stats)
+	})
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+/*
+OAuth2AuthenticatorConfig - A config object for an OAuth2-backed authenticator. The provider login
+flow is only ever used to resolve the caller's identity; once resolved, a leaps token is issued and
+the websocket handshake proceeds exactly as it would with any other authenticator.
+*/
+type OAuth2AuthenticatorConfig struct {
+	Provider       string   `json:"provider" yaml:"provider"`
+	ClientID       string   `json:"client_id" yaml:"client_id"`
+	ClientSecret   string   `json:"client_secret" yaml:"client_secret"`
+	RedirectURL    string   `json:"redirect_url" yaml:"redirect_url"`
+	Scopes         []string `json:"scopes" yaml:"scopes"`
+	AuthURL        string   `json:"auth_url" yaml:"auth_url"`
+	TokenURL       string   `json:"token_url" yaml:"token_url"`
+	UserInfoURL    string   `json:"user_info_url" yaml:"user_info_url"`
+	AllowedOrgs    []string `json:"allowed_orgs" yaml:"allowed_orgs"`
+	AllowedDomains []string `json:"allowed_domains" yaml:"allowed_domains"`
+	StateSecret    string   `json:"state_secret" yaml:"state_secret"`
+	Path           string   `json:"path" yaml:"path"`
+}
+
+/*
+NewOAuth2AuthenticatorConfig - Returns a default config object for an OAuth2Authenticator.
+*/
+func NewOAuth2AuthenticatorConfig() OAuth2AuthenticatorConfig {
+	return OAuth2AuthenticatorConfig{
+		Provider:       "github",
+		ClientID:       "",
+		ClientSecret:   "",
+		RedirectURL:    "",
+		Scopes:         []string{},
+		AuthURL:        "",
+		TokenURL:       "",
+		UserInfoURL:    "",
+		AllowedOrgs:    []string{},
+		AllowedDomains: []string{},
+		StateSecret:    "",
+		Path:           "oauth",
+	}
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+/*
+oauthUserInfo - The subset of a provider's user-profile response that we care about, normalised into
+a common shape. Orgs and Domain are populated from whatever provider-specific response field (or
+additional endpoint) actually carries that information; none of the supported providers name these
+"orgs"/"domain" in their own APIs, so fetchUserInfo maps each named provider's raw response into
+this shape rather than unmarshalling directly into it (only a "generic" provider's response is
+unmarshalled directly).
+*/
+type oauthUserInfo struct {
+	ID     string
+	Login  string
+	Email  string
+	Orgs   []string
+	Domain string
+}
+
+/*
+OAuth2Authenticator - Authenticates create/join requests against a short-lived leaps token. A create
+token bound to the resolved user is issued after the bearer has completed an OAuth2 login with a
+supported provider (GitHub, Google, Bitbucket, or a generic provider configured with explicit
+endpoint URLs); tokens can also be issued through the embedded HTTPAuthenticator's private
+create/join endpoints, which RegisterHandlers registers as well. It delegates the
+actual token issuance/verification to an embedded HTTPAuthenticator, so AuthoriseCreate/AuthoriseJoin
+behave identically to the HTTP authenticator once a client holds a token.
+*/
+type OAuth2Authenticator struct {
+	logger *log.Logger
+	stats  *log.Stats
+	config TokenAuthenticatorConfig
+	oauth  *oauth2.Config
+	tokens *HTTPAuthenticator
+}
+
+/*
+NewOAuth2Authenticator - Creates an OAuth2Authenticator using the provided configuration.
+*/
+func NewOAuth2Authenticator(config TokenAuthenticatorConfig, logger *log.Logger, stats *log.Stats) (*OAuth2Authenticator, error) {
+	if err := validateAllowedOrgs(config.OAuth2Config); err != nil {
+		return nil, err
+	}
+
+	tokens, err := NewHTTPAuthenticator(config, logger, stats)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise token issuer: %v", err)
+	}
+
+	o := OAuth2Authenticator{
+		logger: logger.NewModule(":oauth2_auth"),
+		stats:  stats,
+		config: config,
+		tokens: tokens,
+	}
+
+	endpoint, err := endpointForProvider(config.OAuth2Config)
+	if err != nil {
+		return nil, err
+	}
+
+	o.oauth = &oauth2.Config{
+		ClientID:     config.OAuth2Config.ClientID,
+		ClientSecret: config.OAuth2Config.ClientSecret,
+		RedirectURL:  config.OAuth2Config.RedirectURL,
+		Scopes:       config.OAuth2Config.Scopes,
+		Endpoint:     endpoint,
+	}
+
+	return &o, nil
+}
+
+/*
+endpointForProvider - Resolves the oauth2 endpoint for a named provider, or builds one from the
+explicit AuthURL/TokenURL pair for a "generic" provider.
+*/
+func endpointForProvider(config OAuth2AuthenticatorConfig) (oauth2.Endpoint, error) {
+	switch config.Provider {
+	case "github":
+		return github.Endpoint, nil
+	case "google":
+		return google.Endpoint, nil
+	case "bitbucket":
+		return bitbucket.Endpoint, nil
+	case "generic":
+		if 0 == len(config.AuthURL) || 0 == len(config.TokenURL) {
+			return oauth2.Endpoint{}, fmt.Errorf("generic oauth2 provider requires auth_url and token_url")
+		}
+		return oauth2.Endpoint{AuthURL: config.AuthURL, TokenURL: config.TokenURL}, nil
+	}
+	return oauth2.Endpoint{}, fmt.Errorf("unrecognised oauth2 provider: %v", config.Provider)
+}
+
+/*
+validateAllowedOrgs - fetchUserInfo only fetches a user's org memberships (info.Orgs) for the
+"github" provider (google/bitbucket have no concept of an org membership list on their base profile
+endpoints, and a "generic" provider only gets info.Orgs if its user-info response happens to carry
+an "orgs" field). Setting AllowedOrgs against any provider other than "github" is therefore rejected
+at startup, rather than letting isAuthorised reject every login whose info.Orgs is empty.
+*/
+func validateAllowedOrgs(config OAuth2AuthenticatorConfig) error {
+	if len(config.AllowedOrgs) > 0 && config.Provider != "github" {
+		return fmt.Errorf("allowed_orgs is only supported for the github provider, got provider: %v", config.Provider)
+	}
+	return nil
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+/*
+AuthoriseCreate - Checks whether a token (issued after a successful OAuth2 login) grants the bearer
+permission to create a new document as userID.
+*/
+func (o *OAuth2Authenticator) AuthoriseCreate(token, userID string) bool {
+	return o.tokens.AuthoriseCreate(token, userID)
+}
+
+/*
+AuthoriseJoin - Checks whether a token (issued after a successful OAuth2 login) grants the bearer
+permission to join documentID.
+*/
+func (o *OAuth2Authenticator) AuthoriseJoin(token, documentID string) bool {
+	return o.tokens.AuthoriseJoin(token, documentID)
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+/*
+signState / verifyState - The `/oauth/login` redirect carries an HMAC-signed state value so that
+`/oauth/callback` can confirm the response corresponds to a login this instance actually initiated,
+without needing any server-side session store.
+*/
+func (o *OAuth2Authenticator) signState(nonce string) string {
+	mac := hmac.New(sha256.New, []byte(o.config.OAuth2Config.StateSecret))
+	mac.Write([]byte(nonce))
+	sig := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+	return nonce + "." + sig
+}
+
+func (o *OAuth2Authenticator) verifyState(state string) bool {
+	parts := []byte(state)
+	sep := -1
+	for i, c := range parts {
+		if c == '.' {
+			sep = i
+		}
+	}
+	if sep < 0 {
+		return false
+	}
+	nonce, sig := state[:sep], state[sep+1:]
+	expected := o.signState(nonce)
+	return hmac.Equal([]byte(expected[sep+1:]), []byte(sig))
+}
+
+/*
+isAuthorised - Applies the configured AllowedOrgs/AllowedDomains restrictions to a resolved user
+profile. With no restrictions configured, any authenticated user is accepted.
+*/
+func (o *OAuth2Authenticator) isAuthorised(info oauthUserInfo) bool {
+	cfg := o.config.OAuth2Config
+
+	if len(cfg.AllowedOrgs) > 0 {
+		allowed := false
+		for _, org := range cfg.AllowedOrgs {
+			for _, userOrg := range info.Orgs {
+				if org == userOrg {
+					allowed = true
+				}
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	if len(cfg.AllowedDomains) > 0 {
+		allowed := false
+		for _, domain := range cfg.AllowedDomains {
+			if domain == info.Domain {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+func (o *OAuth2Authenticator) serveLogin(w http.ResponseWriter, r *http.Request) {
+	nonce := GenerateStampedUUID()
+	state := o.signState(nonce)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "leaps_oauth_state",
+		Value:    state,
+		Path:     "/",
+		Expires:  time.Now().Add(time.Minute * 10),
+		HttpOnly: true,
+	})
+
+	http.Redirect(w, r, o.oauth.AuthCodeURL(state), http.StatusFound)
+}
+
+func (o *OAuth2Authenticator) serveCallback(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	if 0 == len(state) || !o.verifyState(state) {
+		http.Error(w, "Invalid or expired login attempt", http.StatusBadRequest)
+		return
+	}
+
+	cookie, err := r.Cookie("leaps_oauth_state")
+	if err != nil || cookie.Value != state {
+		http.Error(w, "Invalid or expired login attempt", http.StatusBadRequest)
+		return
+	}
+
+	code := r.URL.Query().Get("code")
+	if 0 == len(code) {
+		http.Error(w, "Bad request: missing code", http.StatusBadRequest)
+		return
+	}
+
+	oauthToken, err := o.oauth.Exchange(r.Context(), code)
+	if err != nil {
+		o.logger.Errorf("OAuth2 code exchange failed: %v\n", err)
+		http.Error(w, "Failed to complete login", http.StatusBadGateway)
+		return
+	}
+
+	info, err := o.fetchUserInfo(r, oauthToken)
+	if err != nil {
+		o.logger.Errorf("Failed to fetch OAuth2 user profile: %v\n", err)
+		http.Error(w, "Failed to complete login", http.StatusBadGateway)
+		return
+	}
+
+	if !o.isAuthorised(info) {
+		http.Error(w, "User is not permitted to access this leaps instance", http.StatusForbidden)
+		return
+	}
+
+	userID := info.Login
+	if 0 == len(userID) {
+		userID = info.ID
+	}
+
+	leapsToken, err := o.tokens.generateToken(scopeCreate, userID, 1)
+	if err != nil {
+		o.logger.Errorf("Failed to issue leaps token: %v\n", err)
+		http.Error(w, "Failed to complete login", http.StatusInternalServerError)
+		return
+	}
+
+	resBytes, err := json.Marshal(struct {
+		Token string `json:"token"`
+	}{
+		Token: leapsToken,
+	})
+	if err != nil {
+		http.Error(w, "Failed to generate response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(resBytes)
+}
+
+func (o *OAuth2Authenticator) serveLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:    "leaps_oauth_state",
+		Value:   "",
+		Path:    "/",
+		Expires: time.Unix(0, 0),
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+fetchUserInfo - Calls the provider's user-info endpoint with the exchanged OAuth2 token and maps the
+response into our common oauthUserInfo shape. Each named provider gets its own mapping, since none of
+them report identity/org/domain information under the same field names (or, in GitHub's case, from
+the same endpoint). A "generic" provider falls back to unmarshalling straight into oauthUserInfo,
+which only works if the operator's user_info_url happens to return that exact shape.
+*/
+func (o *OAuth2Authenticator) fetchUserInfo(r *http.Request, token *oauth2.Token) (oauthUserInfo, error) {
+	provider := o.config.OAuth2Config.Provider
+
+	userInfoURL := o.config.OAuth2Config.UserInfoURL
+	if 0 == len(userInfoURL) {
+		switch provider {
+		case "github":
+			userInfoURL = "https://api.github.com/user"
+		case "google":
+			userInfoURL = "https://www.googleapis.com/oauth2/v2/userinfo"
+		case "bitbucket":
+			userInfoURL = "https://api.bitbucket.org/2.0/user"
+		default:
+			return oauthUserInfo{}, fmt.Errorf("no user_info_url configured for provider: %v", provider)
+		}
+	}
+
+	client := o.oauth.Client(r.Context(), token)
+	bodyBytes, err := getJSON(client, userInfoURL)
+	if err != nil {
+		return oauthUserInfo{}, err
+	}
+
+	var info oauthUserInfo
+	switch provider {
+	case "github":
+		info, err = githubUserInfoFrom(bodyBytes)
+	case "google":
+		info, err = googleUserInfoFrom(bodyBytes)
+	case "bitbucket":
+		info, err = bitbucketUserInfoFrom(bodyBytes)
+	default:
+		err = json.Unmarshal(bodyBytes, &info)
+	}
+	if err != nil {
+		return oauthUserInfo{}, err
+	}
+
+	if provider == "github" && len(o.config.OAuth2Config.AllowedOrgs) > 0 {
+		if info.Orgs, err = githubOrgsFor(client); err != nil {
+			return oauthUserInfo{}, err
+		}
+	}
+
+	return info, nil
+}
+
+/*
+getJSON - GETs url with client and returns the response body, erroring on any non-200 status.
+*/
+func getJSON(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request to %v returned status %v", url, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+/*
+githubUserInfoResponse - The subset of GitHub's `/user` response we care about. GitHub has no "orgs"
+field on this endpoint; org membership is only available from the separate /user/orgs endpoint, see
+githubOrgsFor.
+*/
+type githubUserInfoResponse struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+	Email string `json:"email"`
+}
+
+func githubUserInfoFrom(bodyBytes []byte) (oauthUserInfo, error) {
+	var raw githubUserInfoResponse
+	if err := json.Unmarshal(bodyBytes, &raw); err != nil {
+		return oauthUserInfo{}, err
+	}
+	return oauthUserInfo{
+		ID:    strconv.FormatInt(raw.ID, 10),
+		Login: raw.Login,
+		Email: raw.Email,
+	}, nil
+}
+
+/*
+githubOrgResponse - A single entry of GitHub's `/user/orgs` response.
+*/
+type githubOrgResponse struct {
+	Login string `json:"login"`
+}
+
+/*
+githubOrgsFor - Fetches the authenticated user's organisation logins from GitHub's /user/orgs
+endpoint, which is the only place GitHub reports org membership (the base /user profile does not).
+*/
+func githubOrgsFor(client *http.Client) ([]string, error) {
+	bodyBytes, err := getJSON(client, "https://api.github.com/user/orgs")
+	if err != nil {
+		return nil, err
+	}
+	return parseGithubOrgs(bodyBytes)
+}
+
+func parseGithubOrgs(bodyBytes []byte) ([]string, error) {
+	var raws []githubOrgResponse
+	if err := json.Unmarshal(bodyBytes, &raws); err != nil {
+		return nil, err
+	}
+	orgs := make([]string, len(raws))
+	for i, raw := range raws {
+		orgs[i] = raw.Login
+	}
+	return orgs, nil
+}
+
+/*
+googleUserInfoResponse - The subset of Google's userinfo response we care about. Google reports the
+Google Workspace hosted domain as "hd", not "domain".
+*/
+type googleUserInfoResponse struct {
+	ID           string `json:"id"`
+	Email        string `json:"email"`
+	HostedDomain string `json:"hd"`
+}
+
+func googleUserInfoFrom(bodyBytes []byte) (oauthUserInfo, error) {
+	var raw googleUserInfoResponse
+	if err := json.Unmarshal(bodyBytes, &raw); err != nil {
+		return oauthUserInfo{}, err
+	}
+	return oauthUserInfo{
+		ID:     raw.ID,
+		Email:  raw.Email,
+		Domain: raw.HostedDomain,
+	}, nil
+}
+
+/*
+bitbucketUserInfoResponse - The subset of Bitbucket's `/2.0/user` response we care about. Bitbucket
+has no org/domain restriction equivalent on this endpoint, so AllowedOrgs/AllowedDomains are not
+supported for this provider.
+*/
+type bitbucketUserInfoResponse struct {
+	UUID     string `json:"uuid"`
+	Username string `json:"username"`
+}
+
+func bitbucketUserInfoFrom(bodyBytes []byte) (oauthUserInfo, error) {
+	var raw bitbucketUserInfoResponse
+	if err := json.Unmarshal(bodyBytes, &raw); err != nil {
+		return oauthUserInfo{}, err
+	}
+	return oauthUserInfo{
+		ID:    raw.UUID,
+		Login: raw.Username,
+	}, nil
+}
+
+/*
+RegisterHandlers - Registers the OAuth2 login/callback/logout endpoints, plus the token endpoints
+inherited from the embedded HTTPAuthenticator so existing create/join flows keep working for
+clients that already hold a leaps token. login and callback are the endpoints an unauthenticated
+end user's browser hits to perform the login redirect and receive the provider's response, so they
+must be public; only logout is registered privately, matching the admin-only gating the embedded
+HTTPAuthenticator uses for its own endpoints.
+*/
+func (o *OAuth2Authenticator) RegisterHandlers(register PubPrivEndpointRegister) error {
+	basePath := o.config.OAuth2Config.Path
+	if err := register.RegisterPublic(
+		path.Join(basePath, "login"),
+		"Redirect to the configured OAuth2 provider to begin a login",
+		o.serveLogin,
+	); err != nil {
+		return err
+	}
+	if err := register.RegisterPublic(
+		path.Join(basePath, "callback"),
+		"OAuth2 provider redirect target; exchanges a code for a leaps auth token",
+		o.serveCallback,
+	); err != nil {
+		return err
+	}
+	if err := register.RegisterPrivate(
+		path.Join(basePath, "logout"),
+		"Clears the local OAuth2 login state",
+		o.serveLogout,
+	); err != nil {
+		return err
+	}
+	return o.tokens.RegisterHandlers(register)
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */
@@ -0,0 +1,146 @@
+package lib
+
+import "testing"
+
+func TestGithubUserInfoFrom(t *testing.T) {
+	sample := []byte(`{
+		"login": "octocat",
+		"id": 1,
+		"email": "octocat@github.com"
+	}`)
+
+	info, err := githubUserInfoFrom(sample)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Login != "octocat" || info.ID != "1" || info.Email != "octocat@github.com" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+}
+
+func TestParseGithubOrgs(t *testing.T) {
+	sample := []byte(`[
+		{"login": "github", "id": 1},
+		{"login": "octo-org", "id": 2}
+	]`)
+
+	orgs, err := parseGithubOrgs(sample)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(orgs) != 2 || orgs[0] != "github" || orgs[1] != "octo-org" {
+		t.Errorf("unexpected orgs: %+v", orgs)
+	}
+}
+
+func TestGoogleUserInfoFrom(t *testing.T) {
+	sample := []byte(`{
+		"id": "117899297976527876",
+		"email": "alice@example.com",
+		"verified_email": true,
+		"hd": "example.com"
+	}`)
+
+	info, err := googleUserInfoFrom(sample)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Email != "alice@example.com" || info.Domain != "example.com" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+}
+
+func TestBitbucketUserInfoFrom(t *testing.T) {
+	sample := []byte(`{
+		"username": "evzijst",
+		"uuid": "{d301aafb-69a8-4479-b4b3-229e94bc6888}",
+		"display_name": "Erik van Zijst"
+	}`)
+
+	info, err := bitbucketUserInfoFrom(sample)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Login != "evzijst" || info.ID != "{d301aafb-69a8-4479-b4b3-229e94bc6888}" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+}
+
+func TestIsAuthorisedOrgsAndDomains(t *testing.T) {
+	o := &OAuth2Authenticator{
+		config: TokenAuthenticatorConfig{
+			OAuth2Config: OAuth2AuthenticatorConfig{
+				AllowedOrgs:    []string{"octo-org"},
+				AllowedDomains: []string{"example.com"},
+			},
+		},
+	}
+
+	if o.isAuthorised(oauthUserInfo{Orgs: []string{"github"}, Domain: "example.com"}) {
+		t.Errorf("expected user without an allowed org to be rejected")
+	}
+	if !o.isAuthorised(oauthUserInfo{Orgs: []string{"github", "octo-org"}, Domain: "example.com"}) {
+		t.Errorf("expected user with an allowed org and domain to be authorised")
+	}
+	if o.isAuthorised(oauthUserInfo{Orgs: []string{"octo-org"}, Domain: "other.com"}) {
+		t.Errorf("expected user with a disallowed domain to be rejected")
+	}
+}
+
+func TestValidateAllowedOrgsRejectsNonGithubProviders(t *testing.T) {
+	cases := []struct {
+		provider string
+		wantErr  bool
+	}{
+		{provider: "github", wantErr: false},
+		{provider: "google", wantErr: true},
+		{provider: "bitbucket", wantErr: true},
+		{provider: "generic", wantErr: true},
+	}
+
+	for _, c := range cases {
+		err := validateAllowedOrgs(OAuth2AuthenticatorConfig{
+			Provider:    c.provider,
+			AllowedOrgs: []string{"some-org"},
+		})
+		if c.wantErr && err == nil {
+			t.Errorf("expected allowed_orgs with provider %v to be rejected at startup", c.provider)
+		}
+		if !c.wantErr && err != nil {
+			t.Errorf("expected allowed_orgs with provider %v to be accepted, got: %v", c.provider, err)
+		}
+	}
+
+	if err := validateAllowedOrgs(OAuth2AuthenticatorConfig{Provider: "google"}); err != nil {
+		t.Errorf("expected no AllowedOrgs configured to be accepted regardless of provider, got: %v", err)
+	}
+}
+
+func TestSignAndVerifyState(t *testing.T) {
+	o := &OAuth2Authenticator{
+		config: TokenAuthenticatorConfig{
+			OAuth2Config: OAuth2AuthenticatorConfig{
+				StateSecret: "shhh",
+			},
+		},
+	}
+
+	state := o.signState("nonce-value")
+	if !o.verifyState(state) {
+		t.Errorf("expected freshly signed state to verify")
+	}
+	if o.verifyState(state + "tampered") {
+		t.Errorf("expected tampered state to fail verification")
+	}
+
+	other := &OAuth2Authenticator{
+		config: TokenAuthenticatorConfig{
+			OAuth2Config: OAuth2AuthenticatorConfig{
+				StateSecret: "different-secret",
+			},
+		},
+	}
+	if other.verifyState(state) {
+		t.Errorf("expected state signed with a different secret to fail verification")
+	}
+}
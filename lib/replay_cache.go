@@ -0,0 +1,152 @@
+/*
+Copyright (c) 2014 Ashley Jeffs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, sub to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package lib
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+/*
+replayCacheEntry - A single JTI tracked by the replay cache, along with the time it expires and
+becomes eligible for eviction.
+*/
+type replayCacheEntry struct {
+	jti     string
+	expires time.Time
+	uses    int
+}
+
+/*
+replayCache - A bounded LRU cache of JWT IDs (JTIs) that have already been consumed. Used to give
+single-use tokens the same "one shot" semantics as the old delete-on-use token map, without needing
+to retain the full token body. When the cache is full the oldest entry is evicted regardless of
+expiry, which bounds memory; an evicted JTI is still recorded in the backing jar until it expires,
+so it is rejected rather than replayed (and a multi-use token evicted early reads as fully spent).
+*/
+type replayCache struct {
+	mutex    sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+	jar      TokenJar
+}
+
+/*
+newReplayCache - Creates a replayCache with a fixed maximum capacity, backed by jar for durable
+single-use tracking across restarts. The capacity still bounds the in-process LRU list so that a
+burst of traffic can't grow memory unbounded between Sweep runs; jar is consulted whenever a JTI is
+not in the LRU list (and written through to on a JTI's first use) so that a redeemed JTI is not
+forgotten purely because it aged out of the LRU list.
+*/
+func newReplayCache(capacity int, jar TokenJar) *replayCache {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &replayCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		jar:      jar,
+	}
+}
+
+/*
+CheckAndUse - Records one use of jti and returns true if that use is within maxUses (a non-positive
+maxUses is treated as 1, today's single-use default), or false if the token has already been used
+maxUses times and should be rejected as a replay. The first use of a jti is additionally written
+through to the backing jar so single-use tokens stay rejected across a restart; use counts beyond
+the first are tracked only in the in-process LRU list, so a multi-use token loses its remaining
+allowance early if the server restarts mid-way through its uses (with a jar that persists across the
+restart) or if its LRU entry is evicted under capacity pressure before all of its uses are consumed
+— the jar only remembers that the jti was touched at all, not how many of its uses remain, so once
+missing from the LRU it reads as fully spent. Size the replay cache's capacity
+(HTTPAuthenticatorConfig.ReplayCacheSize) generously if multi-use tokens with max_uses > 1 matter to
+your deployment.
+*/
+func (r *replayCache) CheckAndUse(jti string, expires time.Time, maxUses int) bool {
+	if maxUses <= 0 {
+		maxUses = 1
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if elem, exists := r.entries[jti]; exists {
+		entry := elem.Value.(replayCacheEntry)
+		if entry.uses >= maxUses {
+			return false
+		}
+		entry.uses++
+		elem.Value = entry
+		r.order.MoveToBack(elem)
+		return true
+	}
+
+	if _, exists := r.jar.Get(jti); exists {
+		return false
+	}
+	if err := r.jar.Put(jti, expires); err != nil {
+		return false
+	}
+
+	elem := r.order.PushBack(replayCacheEntry{jti: jti, expires: expires, uses: 1})
+	r.entries[jti] = elem
+
+	for r.order.Len() > r.capacity {
+		oldest := r.order.Front()
+		r.order.Remove(oldest)
+		delete(r.entries, oldest.Value.(replayCacheEntry).jti)
+	}
+
+	return true
+}
+
+/*
+Sweep - Removes any entries that have passed their expiry time, both from the in-process LRU list
+and from the backing jar, allowing memory (and, for a file-backed jar, disk) to shrink back down
+when traffic is low.
+*/
+func (r *replayCache) Sweep(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var next *list.Element
+	for elem := r.order.Front(); elem != nil; elem = next {
+		next = elem.Next()
+		entry := elem.Value.(replayCacheEntry)
+		if entry.expires.Before(now) {
+			r.order.Remove(elem)
+			delete(r.entries, entry.jti)
+		}
+	}
+
+	r.jar.Sweep(now)
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */
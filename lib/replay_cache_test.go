@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckAndUseSingleUseRejectsReplay(t *testing.T) {
+	r := newReplayCache(10, NewMemoryTokenJar())
+	expires := time.Now().Add(time.Hour)
+
+	if !r.CheckAndUse("jti-1", expires, 1) {
+		t.Fatalf("expected first use to be accepted")
+	}
+	if r.CheckAndUse("jti-1", expires, 1) {
+		t.Errorf("expected second use of a maxUses=1 token to be rejected as a replay")
+	}
+}
+
+func TestCheckAndUseRespectsMaxUses(t *testing.T) {
+	r := newReplayCache(10, NewMemoryTokenJar())
+	expires := time.Now().Add(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if !r.CheckAndUse("jti-multi", expires, 3) {
+			t.Fatalf("expected use %v/3 to be accepted", i+1)
+		}
+	}
+	if r.CheckAndUse("jti-multi", expires, 3) {
+		t.Errorf("expected a 4th use beyond maxUses to be rejected")
+	}
+}
+
+func TestCheckAndUseRejectsAlreadyInJar(t *testing.T) {
+	jar := NewMemoryTokenJar()
+	expires := time.Now().Add(time.Hour)
+	if err := jar.Put("jti-jar", expires); err != nil {
+		t.Fatalf("unexpected error priming jar: %v", err)
+	}
+
+	r := newReplayCache(10, jar)
+	if r.CheckAndUse("jti-jar", expires, 1) {
+		t.Errorf("expected a jti already recorded in the jar to be rejected even though it is not in the in-process LRU")
+	}
+}
+
+func TestCheckAndUseEvictsOldestWhenCapacityExceeded(t *testing.T) {
+	r := newReplayCache(2, NewMemoryTokenJar())
+	expires := time.Now().Add(time.Hour)
+
+	r.CheckAndUse("jti-a", expires, 1)
+	r.CheckAndUse("jti-b", expires, 1)
+	r.CheckAndUse("jti-c", expires, 1)
+
+	if r.order.Len() != 2 {
+		t.Errorf("expected in-process LRU to stay bounded at capacity, got %v entries", r.order.Len())
+	}
+	if _, exists := r.entries["jti-a"]; exists {
+		t.Errorf("expected the oldest entry to have been evicted from the in-process LRU")
+	}
+}
+
+func TestCheckAndUseMultiUseTokenLosesRemainingAllowanceIfEvictedEarly(t *testing.T) {
+	r := newReplayCache(1, NewMemoryTokenJar())
+	expires := time.Now().Add(time.Hour)
+
+	if !r.CheckAndUse("jti-multi", expires, 3) {
+		t.Fatalf("expected first use of a multi-use token to be accepted")
+	}
+
+	// Pushes "jti-multi" out of the capacity-1 in-process LRU, even though it has 2 uses left.
+	r.CheckAndUse("jti-other", expires, 1)
+
+	if r.CheckAndUse("jti-multi", expires, 3) {
+		t.Errorf("documented tradeoff: a multi-use token's remaining allowance is lost once its LRU entry is evicted, since the jar only records that the jti was touched at all")
+	}
+}
+
+func TestSweepRemovesExpiredEntries(t *testing.T) {
+	jar := NewMemoryTokenJar()
+	r := newReplayCache(10, jar)
+
+	past := time.Now().Add(-time.Hour)
+	r.CheckAndUse("jti-expired", past, 1)
+
+	r.Sweep(time.Now())
+
+	if _, exists := r.entries["jti-expired"]; exists {
+		t.Errorf("expected expired entry to be swept from the in-process LRU")
+	}
+	if _, exists := jar.Get("jti-expired"); exists {
+		t.Errorf("expected expired entry to be swept from the backing jar")
+	}
+}
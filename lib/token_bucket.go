@@ -0,0 +1,153 @@
+/*
+Copyright (c) 2014 Ashley Jeffs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, sub to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+/*
+tokenBucket - A single per-key token bucket: capacity tokens refilled at rate tokens/second, drained
+one token per allowed request.
+*/
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+/*
+ipRateLimiter - A token-bucket rate limiter keyed by remote IP, used to throttle the token-generation
+endpoint against a misconfigured or malicious caller flooding it. Buckets for IPs that haven't been
+seen in a while are evicted by Sweep, which the HTTPAuthenticator calls from the same periodic loop
+that sweeps the replay cache, so memory doesn't grow unbounded under a flood that varies its source
+IP.
+*/
+type ipRateLimiter struct {
+	mutex   sync.Mutex
+	rps     float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+/*
+newIPRateLimiter - Creates a limiter allowing `rps` requests per second per IP, with a burst
+allowance of `burst` requests. A non-positive rps disables rate limiting entirely.
+*/
+func newIPRateLimiter(rps float64, burst int) *ipRateLimiter {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &ipRateLimiter{
+		rps:     rps,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+/*
+Allow - Returns true if a request from ip may proceed right now, consuming a token if so. When the
+limiter is disabled (rps <= 0) every request is allowed.
+*/
+func (l *ipRateLimiter) Allow(ip string) bool {
+	if l.rps <= 0 {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[ip] = bucket
+	}
+
+	elapsed := now.Sub(bucket.lastSeen).Seconds()
+	bucket.lastSeen = now
+	bucket.tokens += elapsed * l.rps
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+/*
+idleTTL - How long a bucket can go unseen before Sweep evicts it: the time it takes an empty bucket
+to refill to full burst, doubled for a safety margin and floored at a minute so a high-rps/low-burst
+config doesn't sweep buckets that are still being actively throttled.
+*/
+func (l *ipRateLimiter) idleTTL() time.Duration {
+	if l.rps <= 0 {
+		return 0
+	}
+	ttl := time.Duration(l.burst / l.rps * 2 * float64(time.Second))
+	if ttl < time.Minute {
+		return time.Minute
+	}
+	return ttl
+}
+
+/*
+Sweep - Evicts buckets that haven't been seen in longer than idleTTL, bounding memory when a flood
+varies its source IP (many proxies, IPv6, or spoofed X-Forwarded-For) instead of hammering a single
+one.
+*/
+func (l *ipRateLimiter) Sweep(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	ttl := l.idleTTL()
+	for ip, bucket := range l.buckets {
+		if now.Sub(bucket.lastSeen) > ttl {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+/*
+RetryAfter - Returns a conservative "try again in N seconds" value for a rejected request, used to
+populate the Retry-After header.
+*/
+func (l *ipRateLimiter) RetryAfter() int {
+	if l.rps <= 0 {
+		return 0
+	}
+	wait := 1 / l.rps
+	if wait < 1 {
+		return 1
+	}
+	return int(wait) + 1
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */
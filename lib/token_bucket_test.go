@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiterAllowsBurstThenThrottles(t *testing.T) {
+	l := newIPRateLimiter(1, 2)
+
+	if !l.Allow("1.2.3.4") {
+		t.Fatalf("expected first request within burst to be allowed")
+	}
+	if !l.Allow("1.2.3.4") {
+		t.Fatalf("expected second request within burst to be allowed")
+	}
+	if l.Allow("1.2.3.4") {
+		t.Errorf("expected a third immediate request to exceed the burst and be rejected")
+	}
+}
+
+func TestIPRateLimiterTracksIPsIndependently(t *testing.T) {
+	l := newIPRateLimiter(1, 1)
+
+	if !l.Allow("1.1.1.1") {
+		t.Fatalf("expected first IP's request to be allowed")
+	}
+	if !l.Allow("2.2.2.2") {
+		t.Errorf("expected a different IP to have its own, unconsumed bucket")
+	}
+}
+
+func TestIPRateLimiterSweepEvictsIdleBuckets(t *testing.T) {
+	l := newIPRateLimiter(10, 10)
+	l.Allow("1.2.3.4")
+
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected one bucket after a single request, got %v", len(l.buckets))
+	}
+
+	l.buckets["1.2.3.4"].lastSeen = time.Now().Add(-time.Hour)
+	l.Sweep(time.Now())
+
+	if len(l.buckets) != 0 {
+		t.Errorf("expected the idle bucket to be evicted by Sweep, got %v remaining", len(l.buckets))
+	}
+}
+
+func TestIPRateLimiterSweepKeepsRecentlySeenBuckets(t *testing.T) {
+	l := newIPRateLimiter(10, 10)
+	l.Allow("1.2.3.4")
+
+	l.Sweep(time.Now())
+
+	if len(l.buckets) != 1 {
+		t.Errorf("expected a recently-seen bucket to survive Sweep, got %v remaining", len(l.buckets))
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Copyright (c) 2014 Ashley Jeffs
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, sub to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jeffail/util/log"
+)
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+/*
+TokenJar - Since leaps tokens became stateless JWTs the only state an authenticator still needs to
+keep is the set of already-redeemed JTIs that enforce single-use semantics. TokenJar abstracts that
+store so it can be held purely in memory or persisted across restarts. Get reports whether a JTI is
+already known along with its expiry, Put records a JTI as redeemed until the given expiry, Delete
+removes a single JTI, and Sweep purges everything that has expired as of `now`.
+*/
+type TokenJar interface {
+	Get(jti string) (time.Time, bool)
+	Put(jti string, expires time.Time) error
+	Delete(jti string) error
+	Sweep(now time.Time) error
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+/*
+MemoryTokenJar - A TokenJar backed by a plain in-memory map, matching the behaviour of the original
+tokensMap: fast, but every redeemed JTI is forgotten on restart. HTTPAuthenticator itself always
+builds a FileTokenJar, which keeps only this in-memory state when no path is configured.
+*/
+type MemoryTokenJar struct {
+	mutex   sync.RWMutex
+	entries map[string]time.Time
+}
+
+/*
+NewMemoryTokenJar - Creates an empty MemoryTokenJar.
+*/
+func NewMemoryTokenJar() *MemoryTokenJar {
+	return &MemoryTokenJar{
+		entries: map[string]time.Time{},
+	}
+}
+
+/*
+Get - Returns the expiry recorded against a JTI, if any.
+*/
+func (m *MemoryTokenJar) Get(jti string) (time.Time, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	expires, ok := m.entries[jti]
+	return expires, ok
+}
+
+/*
+Put - Records a JTI as redeemed until the given expiry.
+*/
+func (m *MemoryTokenJar) Put(jti string, expires time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.entries[jti] = expires
+	return nil
+}
+
+/*
+Delete - Forgets a single JTI.
+*/
+func (m *MemoryTokenJar) Delete(jti string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.entries, jti)
+	return nil
+}
+
+/*
+Sweep - Removes every JTI that expired before `now`.
+*/
+func (m *MemoryTokenJar) Sweep(now time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for jti, expires := range m.entries {
+		if expires.Before(now) {
+			delete(m.entries, jti)
+		}
+	}
+	return nil
+}
+
+/*
+snapshot - Returns a copy of the current entries, used by FileTokenJar to serialise state.
+*/
+func (m *MemoryTokenJar) snapshot() map[string]time.Time {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	out := make(map[string]time.Time, len(m.entries))
+	for jti, expires := range m.entries {
+		out[jti] = expires
+	}
+	return out
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */
+
+/*
+FileTokenJarConfig - A config object for a FileTokenJar.
+*/
+type FileTokenJarConfig struct {
+	Path          string `json:"path" yaml:"path"`
+	WriteInterval int64  `json:"write_interval_s" yaml:"write_interval_s"`
+	WriteOnPut    bool   `json:"write_on_put" yaml:"write_on_put"`
+}
+
+/*
+NewFileTokenJarConfig - Returns a default config object for a FileTokenJar.
+*/
+func NewFileTokenJarConfig() FileTokenJarConfig {
+	return FileTokenJarConfig{
+		Path:          "",
+		WriteInterval: 10,
+		WriteOnPut:    false,
+	}
+}
+
+/*
+FileTokenJar - A TokenJar that keeps its entries in memory for fast access but mirrors them to a
+JSON file on disk, so that a process restart (or crash) does not silently re-open the single-use
+window on every token that was already redeemed but has not yet expired. The file is flushed on a
+timer, and
+optionally after every Put for callers that would rather trade a little latency for never losing a
+write.
+*/
+type FileTokenJar struct {
+	config FileTokenJarConfig
+	logger *log.Logger
+	mem    *MemoryTokenJar
+}
+
+/*
+NewFileTokenJar - Creates a FileTokenJar, loading any existing entries from config.Path and dropping
+ones that have already expired. Starts a background goroutine that flushes to disk every
+WriteInterval seconds.
+*/
+func NewFileTokenJar(config FileTokenJarConfig, logger *log.Logger) (*FileTokenJar, error) {
+	f := FileTokenJar{
+		config: config,
+		logger: logger,
+		mem:    NewMemoryTokenJar(),
+	}
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	if err := f.mem.Sweep(time.Now()); err != nil {
+		return nil, err
+	}
+
+	go f.loop()
+
+	return &f, nil
+}
+
+/*
+Get - Returns the expiry recorded against a JTI, if any.
+*/
+func (f *FileTokenJar) Get(jti string) (time.Time, bool) {
+	return f.mem.Get(jti)
+}
+
+/*
+Put - Records a JTI as redeemed until the given expiry, optionally flushing to disk immediately.
+*/
+func (f *FileTokenJar) Put(jti string, expires time.Time) error {
+	if err := f.mem.Put(jti, expires); err != nil {
+		return err
+	}
+	if f.config.WriteOnPut {
+		return f.flush()
+	}
+	return nil
+}
+
+/*
+Delete - Forgets a single JTI.
+*/
+func (f *FileTokenJar) Delete(jti string) error {
+	return f.mem.Delete(jti)
+}
+
+/*
+Sweep - Removes every JTI that expired before `now` and flushes the result to disk.
+*/
+func (f *FileTokenJar) Sweep(now time.Time) error {
+	if err := f.mem.Sweep(now); err != nil {
+		return err
+	}
+	return f.flush()
+}
+
+/*
+load - Reads the jar file from disk, if it exists, and populates the in-memory map.
+*/
+func (f *FileTokenJar) load() error {
+	if 0 == len(f.config.Path) {
+		return nil
+	}
+
+	bytes, err := ioutil.ReadFile(f.config.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries map[string]time.Time
+	if err = json.Unmarshal(bytes, &entries); err != nil {
+		return err
+	}
+
+	for jti, expires := range entries {
+		if err = f.mem.Put(jti, expires); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+flush - Serialises the current entries and writes them to config.Path.
+*/
+func (f *FileTokenJar) flush() error {
+	if 0 == len(f.config.Path) {
+		return nil
+	}
+
+	bytes, err := json.Marshal(f.mem.snapshot())
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(f.config.Path, bytes, 0644)
+}
+
+/*
+loop - Periodically flushes the jar to disk so that writes made without WriteOnPut are still
+persisted within one interval.
+*/
+func (f *FileTokenJar) loop() {
+	interval := f.config.WriteInterval
+	if interval <= 0 {
+		interval = 10
+	}
+
+	for range time.Tick(time.Second * time.Duration(interval)) {
+		if err := f.flush(); err != nil && f.logger != nil {
+			f.logger.Errorf("Failed to flush token jar: %v\n", err)
+		}
+	}
+}
+
+/*--------------------------------------------------------------------------------------------------
+ */